@@ -0,0 +1,117 @@
+package ehco
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// EncodeDecoder wraps a net.Conn to apply (or remove) an obfuscation or
+// encryption layer around the relayed bytes, so a stream can ride through
+// infrastructure that only passes HTTP(S). Implementations should abort
+// their handshake promptly once ctx is canceled, e.g. via watchContext or
+// tls.Conn.HandshakeContext, so a stuck peer can't leak the calling
+// goroutine past Shutdown.
+type EncodeDecoder interface {
+	// Encode wraps the conn HandleTCPConn just dialed to the remote
+	// address, completing whatever handshake the far side expects.
+	Encode(ctx context.Context, conn net.Conn) (net.Conn, error)
+	// Decode wraps a conn RunLocalTCPServer just accepted, completing
+	// whatever handshake the connecting side (a peer ehco, or a generic
+	// client) sent.
+	Decode(ctx context.Context, conn net.Conn) (net.Conn, error)
+}
+
+// TransportMode selects which EncodeDecoder a Relay applies around the bytes
+// it relays.
+type TransportMode string
+
+const (
+	// TransportModeRaw passes bytes through unmodified; this is the
+	// default and matches ehco's original behavior.
+	TransportModeRaw TransportMode = ""
+	// TransportModeTLS wraps the stream in TLS.
+	TransportModeTLS TransportMode = "tls"
+	// TransportModeWebSocket wraps the stream in a WebSocket frame
+	// stream via an HTTP/1.1 Upgrade handshake.
+	TransportModeWebSocket TransportMode = "ws"
+)
+
+type rawCodec struct{}
+
+func (rawCodec) Encode(ctx context.Context, conn net.Conn) (net.Conn, error) { return conn, nil }
+func (rawCodec) Decode(ctx context.Context, conn net.Conn) (net.Conn, error) { return conn, nil }
+
+// TLSCodec is an EncodeDecoder that wraps conns with tls.Client/tls.Server.
+type TLSCodec struct {
+	Config *tls.Config
+}
+
+func (t *TLSCodec) Encode(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	tc := tls.Client(conn, t.Config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+func (t *TLSCodec) Decode(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	tc := tls.Server(conn, t.Config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// RelayOption configures optional Relay fields at construction time.
+type RelayOption func(*Relay)
+
+// WithTransportMode sets both ListenTransportMode and DialTransportMode to
+// mode, applying the same EncodeDecoder symmetrically to the accepted and
+// dialed legs. Use WithListenTransportMode/WithDialTransportMode instead to
+// configure them independently, e.g. to decode an inbound WS/TLS handshake
+// and dial a plain backend.
+func WithTransportMode(mode TransportMode) RelayOption {
+	return func(r *Relay) {
+		r.ListenTransportMode = mode
+		r.DialTransportMode = mode
+	}
+}
+
+// WithListenTransportMode sets the EncodeDecoder applied to the
+// locally-accepted leg of each relayed TCP connection.
+func WithListenTransportMode(mode TransportMode) RelayOption {
+	return func(r *Relay) { r.ListenTransportMode = mode }
+}
+
+// WithDialTransportMode sets the EncodeDecoder applied to the leg dialed to
+// the remote address of each relayed TCP connection.
+func WithDialTransportMode(mode TransportMode) RelayOption {
+	return func(r *Relay) { r.DialTransportMode = mode }
+}
+
+// WithTLSConfig sets the *tls.Config used wherever ListenTransportMode or
+// DialTransportMode is TransportModeTLS.
+func WithTLSConfig(cfg *tls.Config) RelayOption {
+	return func(r *Relay) { r.TLSConfig = cfg }
+}
+
+// WithWSPath sets the HTTP path used for the WebSocket upgrade handshake
+// wherever ListenTransportMode or DialTransportMode is
+// TransportModeWebSocket. Defaults to "/".
+func WithWSPath(path string) RelayOption {
+	return func(r *Relay) { r.WSPath = path }
+}
+
+// buildCodec resolves a TransportMode (and the Relay's related config
+// fields) into the EncodeDecoder HandleTCPConn applies on that leg.
+func (relay *Relay) buildCodec(mode TransportMode) EncodeDecoder {
+	switch mode {
+	case TransportModeTLS:
+		return &TLSCodec{Config: relay.TLSConfig}
+	case TransportModeWebSocket:
+		return &WebSocketCodec{Path: relay.WSPath}
+	default:
+		return rawCodec{}
+	}
+}
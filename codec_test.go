@@ -0,0 +1,207 @@
+package ehco
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// generateTestTLSCert returns a minimal self-signed cert/key pair valid for
+// "127.0.0.1", for exercising TLSCodec without touching the filesystem.
+func generateTestTLSCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSCodecRoundTrip(t *testing.T) {
+	cert := generateTestTLSCert(t)
+	serverCodec := &TLSCodec{Config: &tls.Config{Certificates: []tls.Certificate{cert}}}
+	clientCodec := &TLSCodec{Config: &tls.Config{InsecureSkipVerify: true}}
+
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	clientCh := make(chan result, 1)
+	serverCh := make(chan result, 1)
+	go func() {
+		c, err := clientCodec.Encode(context.Background(), clientRaw)
+		clientCh <- result{c, err}
+	}()
+	go func() {
+		c, err := serverCodec.Decode(context.Background(), serverRaw)
+		serverCh <- result{c, err}
+	}()
+
+	clientRes, serverRes := <-clientCh, <-serverCh
+	if clientRes.err != nil {
+		t.Fatalf("Encode: %v", clientRes.err)
+	}
+	if serverRes.err != nil {
+		t.Fatalf("Decode: %v", serverRes.err)
+	}
+	defer clientRes.conn.Close()
+	defer serverRes.conn.Close()
+
+	const msg = "hello over tls"
+	go clientRes.conn.Write([]byte(msg))
+	buf := make([]byte, len(msg))
+	if _, err := readFull(serverRes.conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+}
+
+func TestTLSCodecEncodeCanceled(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	codec := &TLSCodec{Config: &tls.Config{InsecureSkipVerify: true}}
+	if _, err := codec.Encode(ctx, clientRaw); err == nil {
+		t.Fatal("expected an error when ctx is already canceled")
+	}
+}
+
+func TestWebSocketCodecRoundTrip(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+
+	serverCodec := &WebSocketCodec{Path: "/relay"}
+	clientCodec := &WebSocketCodec{Path: "/relay"}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	clientCh := make(chan result, 1)
+	serverCh := make(chan result, 1)
+	go func() {
+		c, err := clientCodec.Encode(context.Background(), clientRaw)
+		clientCh <- result{c, err}
+	}()
+	go func() {
+		c, err := serverCodec.Decode(context.Background(), serverRaw)
+		serverCh <- result{c, err}
+	}()
+
+	clientRes, serverRes := <-clientCh, <-serverCh
+	if clientRes.err != nil {
+		t.Fatalf("Encode: %v", clientRes.err)
+	}
+	if serverRes.err != nil {
+		t.Fatalf("Decode: %v", serverRes.err)
+	}
+	defer clientRes.conn.Close()
+	defer serverRes.conn.Close()
+
+	// Exercise both the short-length frame and the 64-bit extended-length
+	// frame in each direction.
+	for _, payload := range [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte("x"), 70000),
+	} {
+		go clientRes.conn.Write(payload)
+		got := make([]byte, len(payload))
+		if _, err := readFull(serverRes.conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("client->server: got %d bytes, want %d", len(got), len(payload))
+		}
+
+		go serverRes.conn.Write(payload)
+		got = make([]byte, len(payload))
+		if _, err := readFull(clientRes.conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("server->client: got %d bytes, want %d", len(got), len(payload))
+		}
+	}
+}
+
+func TestWebSocketCodecDecodeRejectsNonUpgrade(t *testing.T) {
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+	defer serverRaw.Close()
+
+	go func() {
+		clientRaw.Write([]byte("GET /relay HTTP/1.1\r\nHost: x\r\n\r\n"))
+	}()
+
+	codec := &WebSocketCodec{Path: "/relay"}
+	if _, err := codec.Decode(context.Background(), serverRaw); err == nil {
+		t.Fatal("expected an error for a non-websocket request")
+	}
+}
+
+// TestRelayAsymmetricTransportModes confirms ListenTransportMode and
+// DialTransportMode build independent codecs, e.g. to accept plain TCP and
+// encode outbound to a WebSocket peer.
+func TestRelayAsymmetricTransportModes(t *testing.T) {
+	relay, err := NewRelay("127.0.0.1:0", "127.0.0.1:0", 0, 0, 0,
+		WithDialTransportMode(TransportModeWebSocket),
+		WithWSPath("/tunnel"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := relay.listenCodec.(rawCodec); !ok {
+		t.Fatalf("listenCodec = %T, want rawCodec", relay.listenCodec)
+	}
+	ws, ok := relay.dialCodec.(*WebSocketCodec)
+	if !ok {
+		t.Fatalf("dialCodec = %T, want *WebSocketCodec", relay.dialCodec)
+	}
+	if ws.Path != "/tunnel" {
+		t.Fatalf("dialCodec path = %q, want /tunnel", ws.Path)
+	}
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := conn.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
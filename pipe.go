@@ -0,0 +1,76 @@
+package ehco
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// pipeBufferPool holds the 32 KiB buffers handed to io.CopyBuffer so the
+// copy loops don't allocate per connection.
+var pipeBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// pipe copies bytes in both directions between a and b until one side
+// returns an error or EOF, then closes both so neither half stays
+// half-open. idleTimeout, if non-zero, is refreshed only on actual
+// read/write progress rather than on every loop iteration; zero disables
+// deadlines entirely and lets io.CopyBuffer take the runtime's splice(2)
+// fast path when both a and b are *net.TCPConn.
+func pipe(a, b net.Conn, idleTimeout time.Duration) error {
+	var g errgroup.Group
+	g.Go(func() error {
+		err := copyWithIdleTimeout(b, a, idleTimeout)
+		a.Close()
+		b.Close()
+		return err
+	})
+	g.Go(func() error {
+		err := copyWithIdleTimeout(a, b, idleTimeout)
+		a.Close()
+		b.Close()
+		return err
+	})
+	return g.Wait()
+}
+
+// copyWithIdleTimeout copies from src to dst using a pooled buffer. With no
+// idleTimeout it delegates straight to io.CopyBuffer, preserving dst's
+// ReaderFrom/src's WriterTo fast paths (e.g. TCP-to-TCP splice). With an
+// idleTimeout it copies in chunks, resetting each side's deadline only when
+// a Read or Write actually makes progress.
+func copyWithIdleTimeout(dst, src net.Conn, idleTimeout time.Duration) error {
+	bfp := pipeBufferPool.Get().(*[]byte)
+	defer pipeBufferPool.Put(bfp)
+
+	if idleTimeout == 0 {
+		_, err := io.CopyBuffer(dst, src, *bfp)
+		return err
+	}
+
+	buf := *bfp
+	for {
+		if err := src.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return err
+		}
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if err := dst.SetWriteDeadline(time.Now().Add(idleTimeout)); err != nil {
+				return err
+			}
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package ehco
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// expandPortRange turns a "host:port" or "host:startPort-endPort" address
+// into the list of concrete "host:port" addresses it denotes, in order.
+func expandPortRange(addr string) ([]string, error) {
+	host, portPart, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, isRange := parsePortRange(portPart)
+	if !isRange {
+		return []string{addr}, nil
+	}
+	if end < start {
+		return nil, fmt.Errorf("ehco: invalid port range %q: end before start", portPart)
+	}
+
+	addrs := make([]string, 0, end-start+1)
+	for p := start; p <= end; p++ {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(p)))
+	}
+	return addrs, nil
+}
+
+// parsePortRange reports whether portPart is a "start-end" range and, if so,
+// its bounds.
+func parsePortRange(portPart string) (start, end int, ok bool) {
+	lo, hi, found := strings.Cut(portPart, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, errLo := strconv.Atoi(lo)
+	end, errHi := strconv.Atoi(hi)
+	if errLo != nil || errHi != nil {
+		return 0, 0, false
+	}
+	return start, end, true
+}
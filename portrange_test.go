@@ -0,0 +1,80 @@
+package ehco
+
+import "testing"
+
+func TestExpandPortRangeSinglePort(t *testing.T) {
+	got, err := expandPortRange("127.0.0.1:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:8000"}; !equalStrings(got, want) {
+		t.Fatalf("expandPortRange = %v, want %v", got, want)
+	}
+}
+
+func TestExpandPortRangeRange(t *testing.T) {
+	got, err := expandPortRange("127.0.0.1:8000-8002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"127.0.0.1:8000", "127.0.0.1:8001", "127.0.0.1:8002"}
+	if !equalStrings(got, want) {
+		t.Fatalf("expandPortRange = %v, want %v", got, want)
+	}
+}
+
+func TestExpandPortRangeEndBeforeStart(t *testing.T) {
+	if _, err := expandPortRange("127.0.0.1:8002-8000"); err == nil {
+		t.Fatal("expected an error for a range with end before start")
+	}
+}
+
+func TestExpandPortRangeSingleWidthMatchesRange(t *testing.T) {
+	got, err := expandPortRange("127.0.0.1:8000-8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"127.0.0.1:8000"}; !equalStrings(got, want) {
+		t.Fatalf("expandPortRange = %v, want %v", got, want)
+	}
+}
+
+func TestParsePortRangeRejectsNonRange(t *testing.T) {
+	if _, _, ok := parsePortRange("8000"); ok {
+		t.Fatal("parsePortRange should not treat a bare port as a range")
+	}
+	if _, _, ok := parsePortRange("http-alt"); ok {
+		t.Fatal("parsePortRange should reject non-numeric bounds")
+	}
+}
+
+func TestNewRelayRejectsMismatchedRangeWidth(t *testing.T) {
+	if _, err := NewRelay("127.0.0.1:8000-8002", "127.0.0.1:9000-9001", 0, 0, 0); err == nil {
+		t.Fatal("expected an error for mismatched local/remote port range widths")
+	}
+}
+
+func TestNewRelayExpandsMatchedRangeWidth(t *testing.T) {
+	relay, err := NewRelay("127.0.0.1:8000-8001", "127.0.0.1:9000-9001", 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relay.LocalTCPAddrs) != 2 || len(relay.RemoteTCPAddrs) != 2 {
+		t.Fatalf("got %d local / %d remote addrs, want 2 each", len(relay.LocalTCPAddrs), len(relay.RemoteTCPAddrs))
+	}
+	if relay.RemoteTCPAddrs[1].Port != 9001 {
+		t.Fatalf("RemoteTCPAddrs[1].Port = %d, want 9001", relay.RemoteTCPAddrs[1].Port)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,179 +1,471 @@
 package ehco
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
+// DefaultDrainTimeout bounds how long Shutdown waits for in-flight TCP and
+// UDP session goroutines to finish once cancellation has been requested.
+const DefaultDrainTimeout = 30 * time.Second
+
+// udpBufferPool holds the 64 KiB scratch buffers used to read UDP packets so
+// that high-PPS relaying doesn't thrash the allocator.
+var udpBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 65536)
+		return &b
+	},
+}
+
+// UDPExchange is one NAT-style mapping between a client source address and
+// the dialed connection that carries its traffic to the matching remote
+// UDP address.
+type UDPExchange struct {
+	RemoteConn *net.UDPConn
+	ClientAddr *net.UDPAddr
+	LocalConn  *net.UDPConn
+
+	key string
+
+	timerMu sync.Mutex
+	timer   *time.Timer
+}
+
 type Relay struct {
-	LocalTCPAddr  *net.TCPAddr
-	LocalUDPAddr  *net.UDPAddr
-	RemoteTCPAddr *net.TCPAddr
-	RemoteUDPAddr *net.UDPAddr
-	TCPListener   *net.TCPListener
-	UDPConn       *net.UDPConn
+	LocalTCPAddrs  []*net.TCPAddr
+	LocalUDPAddrs  []*net.UDPAddr
+	RemoteTCPAddrs []*net.TCPAddr
+	RemoteUDPAddrs []*net.UDPAddr
+	TCPListeners   []*net.TCPListener
+	UDPConns       []*net.UDPConn
+	Transport      Transport
+
+	// ListenTransportMode and DialTransportMode independently configure the
+	// EncodeDecoder applied to the locally-accepted leg (Decode) and the
+	// leg dialed to the remote address (Encode), so a single Relay can sit
+	// asymmetrically between e.g. a plain local client and a WS/TLS peer.
+	// TLSConfig and WSPath are shared by whichever side(s) use them; see
+	// buildCodec.
+	ListenTransportMode TransportMode
+	DialTransportMode   TransportMode
+	TLSConfig           *tls.Config
+	WSPath              string
+	listenCodec         EncodeDecoder
+	dialCodec           EncodeDecoder
 
+	TCPTimeout  int
 	TCPDeadline int
 	UDPDeadline int
+
+	// DrainTimeout bounds how long Shutdown waits for in-flight
+	// connections to finish after cancellation. Zero means
+	// DefaultDrainTimeout.
+	DrainTimeout time.Duration
+
+	// UDPExchanges tracks the live client->remote UDP sessions keyed by
+	// port index and the client's addr.String(), so tests (and callers)
+	// can inspect session state.
+	UDPExchanges   map[string]*UDPExchange
+	udpExchangesMu sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
-func NewRelay(localAddr, remoteAddr string, tcpTimeout, tcpDeadline, udpDeadline int) (*Relay, error) {
-	localTCPAddr, err := net.ResolveTCPAddr("tcp", localAddr)
-	if err != nil {
-		return nil, err
-	}
-	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
+// NewRelay builds a Relay between localAddr and remoteAddr. Either may name
+// a single port ("host:8000") or a port range ("host:8000-8010"), in which
+// case local port N is relayed to remote port N by offset and a listener is
+// set up per port. Ranges must be the same width on both sides.
+func NewRelay(localAddr, remoteAddr string, tcpTimeout, tcpDeadline, udpDeadline int, opts ...RelayOption) (*Relay, error) {
+	localAddrs, err := expandPortRange(localAddr)
 	if err != nil {
 		return nil, err
 	}
-	remoteTCPAddr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	remoteAddrs, err := expandPortRange(remoteAddr)
 	if err != nil {
 		return nil, err
 	}
-	remoteUDPAddr, err := net.ResolveUDPAddr("udp", remoteAddr)
-	if err != nil {
-		return nil, err
+	if len(localAddrs) != len(remoteAddrs) {
+		return nil, fmt.Errorf("ehco: local port range width %d does not match remote port range width %d", len(localAddrs), len(remoteAddrs))
 	}
 
+	n := len(localAddrs)
 	s := &Relay{
-		LocalTCPAddr:  localTCPAddr,
-		LocalUDPAddr:  localUDPAddr,
-		RemoteTCPAddr: remoteTCPAddr,
-		RemoteUDPAddr: remoteUDPAddr,
+		LocalTCPAddrs:  make([]*net.TCPAddr, n),
+		LocalUDPAddrs:  make([]*net.UDPAddr, n),
+		RemoteTCPAddrs: make([]*net.TCPAddr, n),
+		RemoteUDPAddrs: make([]*net.UDPAddr, n),
+		TCPListeners:   make([]*net.TCPListener, n),
+		UDPConns:       make([]*net.UDPConn, n),
+		Transport:      DirectTransport{},
 
 		TCPTimeout:  tcpTimeout,
 		TCPDeadline: tcpDeadline,
 		UDPDeadline: udpDeadline,
+
+		UDPExchanges: make(map[string]*UDPExchange),
+	}
+
+	for i := 0; i < n; i++ {
+		if s.LocalTCPAddrs[i], err = net.ResolveTCPAddr("tcp", localAddrs[i]); err != nil {
+			return nil, err
+		}
+		if s.LocalUDPAddrs[i], err = net.ResolveUDPAddr("udp", localAddrs[i]); err != nil {
+			return nil, err
+		}
+		if s.RemoteTCPAddrs[i], err = net.ResolveTCPAddr("tcp", remoteAddrs[i]); err != nil {
+			return nil, err
+		}
+		if s.RemoteUDPAddrs[i], err = net.ResolveUDPAddr("udp", remoteAddrs[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
+	s.listenCodec = s.buildCodec(s.ListenTransportMode)
+	s.dialCodec = s.buildCodec(s.DialTransportMode)
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	return s, nil
 }
 
-func (relay *Relay) ListenAndServe() error {
-	errChan := make(chan error)
-	go func() {
-		errChan <- relay.RunLocalTCPServer()
-	}()
-	go func() {
-		errChan <- relay.RunLocalUDPServer()
-	}()
-	return <-errChan
+// NewRelayWithTransport is like NewRelay but dials the upstream leg of each
+// TCP connection through transport instead of directly to the remote
+// address, e.g. a GostRelayTransport to chain through an existing gost
+// server.
+func NewRelayWithTransport(localAddr, remoteAddr string, tcpTimeout, tcpDeadline, udpDeadline int, transport Transport, opts ...RelayOption) (*Relay, error) {
+	relay, err := NewRelay(localAddr, remoteAddr, tcpTimeout, tcpDeadline, udpDeadline, opts...)
+	if err != nil {
+		return nil, err
+	}
+	relay.Transport = transport
+	return relay, nil
+}
+
+// ListenAndServe runs the local TCP and UDP servers for every configured
+// port until they return, e.g. once Shutdown closes their listeners.
+// Canceling ctx unblocks in-flight TCP connections and UDP sessions but does
+// not close the listeners. It returns once all of the servers have stopped,
+// joining any errors they reported.
+func (relay *Relay) ListenAndServe(ctx context.Context) error {
+	relay.ctx, relay.cancel = context.WithCancel(ctx)
+
+	n := len(relay.LocalTCPAddrs)
+	errChan := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			errChan <- relay.RunLocalTCPServer(i)
+		}()
+		go func() {
+			errChan <- relay.RunLocalUDPServer(i)
+		}()
+	}
+
+	errs := make([]error, 2*n)
+	for i := range errs {
+		errs[i] = <-errChan
+	}
+	return errors.Join(errs...)
 }
 
-func (relay *Relay) RunLocalTCPServer() error {
+// RunLocalTCPServer accepts connections on LocalTCPAddrs[i] and relays each
+// to RemoteTCPAddrs[i].
+func (relay *Relay) RunLocalTCPServer(i int) error {
 	var err error
-	relay.TCPListener, err = net.ListenTCP("tcp", relay.LocalTCPAddr)
+	relay.TCPListeners[i], err = net.ListenTCP("tcp", relay.LocalTCPAddrs[i])
 	if err != nil {
 		return err
 	}
-	defer relay.TCPListener.Close()
+	defer relay.TCPListeners[i].Close()
 	for {
-		c, err := relay.TCPListener.AcceptTCP()
+		c, err := relay.TCPListeners[i].AcceptTCP()
 		if err != nil {
+			if relay.ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
-		go func(c *net.TCPConn) {
-			defer c.Close()
-			if relay.TCPDeadline != 0 {
-				if err := c.SetDeadline(time.Now().Add(time.Duration(relay.TCPDeadline) * time.Second)); err != nil {
-					log.Println(err)
-					return
-				}
-			}
-			if err := relay.HandleTCPConn(c); err != nil {
-				log.Println(err)
-			}
-		}(c)
+		relay.wg.Add(1)
+		go relay.serveTCPConn(c, relay.RemoteTCPAddrs[i])
+	}
+}
+
+// serveTCPConn drives one accepted connection. It registers with relay.wg so
+// Shutdown can wait for it to drain, and unblocks its own Read via
+// SetDeadline once relay.ctx is canceled.
+func (relay *Relay) serveTCPConn(c *net.TCPConn, remoteAddr *net.TCPAddr) {
+	defer relay.wg.Done()
+	defer c.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-relay.ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	if relay.TCPDeadline != 0 {
+		if err := c.SetDeadline(time.Now().Add(time.Duration(relay.TCPDeadline) * time.Second)); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+	if err := relay.HandleTCPConn(c, remoteAddr); err != nil {
+		log.Println(err)
 	}
-	return nil
 }
 
-func (relay *Relay) RunLocalUDPServer() error {
+// RunLocalUDPServer reads packets on LocalUDPAddrs[i] and relays each to
+// RemoteUDPAddrs[i].
+func (relay *Relay) RunLocalUDPServer(i int) error {
 	var err error
-	relay.UDPConn, err = net.ListenUDP("udp", relay.LocalUDPAddr)
+	relay.UDPConns[i], err = net.ListenUDP("udp", relay.LocalUDPAddrs[i])
 	if err != nil {
 		return err
 	}
-	defer relay.UDPConn.Close()
+	defer relay.UDPConns[i].Close()
 	for {
-		b := make([]byte, 65536)
-		n, addr, err := relay.UDPConn.ReadFromUDP(b)
+		bfp := udpBufferPool.Get().(*[]byte)
+		n, addr, err := relay.UDPConns[i].ReadFromUDP(*bfp)
 		if err != nil {
+			udpBufferPool.Put(bfp)
+			if relay.ctx.Err() != nil {
+				return nil
+			}
 			return err
 		}
-		go func(addr *net.UDPAddr, b []byte) {
-			if err := relay.HandleUDP(addr, b); err != nil {
+		relay.wg.Add(1)
+		go func(addr *net.UDPAddr, bfp *[]byte, n int) {
+			defer relay.wg.Done()
+			defer udpBufferPool.Put(bfp)
+			if err := relay.HandleUDP(i, addr, (*bfp)[0:n]); err != nil {
 				log.Println(err)
 				return
 			}
-		}(addr, b[0:n])
+		}(addr, bfp, n)
 	}
-	return nil
 }
 
+// Shutdown stops accepting new connections, cancels relay's context so
+// in-flight TCP and UDP session goroutines unblock their Reads, and waits
+// up to DrainTimeout for them to finish before returning.
 func (relay *Relay) Shutdown() error {
-	var err, err1 error
-	if relay.TCPListener != nil {
-		err = relay.TCPListener.Close()
+	// Cancel before closing the listeners/conns: RunLocalTCPServer and
+	// RunLocalUDPServer only swallow their Accept/ReadFromUDP error when
+	// relay.ctx is already canceled, so closing first could otherwise
+	// surface a spurious "use of closed network connection" error for
+	// this intentional shutdown.
+	if relay.cancel != nil {
+		relay.cancel()
 	}
-	if relay.UDPConn != nil {
-		err1 = relay.UDPConn.Close()
+
+	var errs []error
+	for _, l := range relay.TCPListeners {
+		if l != nil {
+			errs = append(errs, l.Close())
+		}
+	}
+	for _, c := range relay.UDPConns {
+		if c != nil {
+			errs = append(errs, c.Close())
+		}
 	}
+
+	drainTimeout := relay.DrainTimeout
+	if drainTimeout == 0 {
+		drainTimeout = DefaultDrainTimeout
+	}
+	drained := make(chan struct{})
+	go func() {
+		relay.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+	}
+
+	return errors.Join(errs...)
+}
+
+// HandleTCPConn decodes c with relay.listenCodec (if it expects a handshake,
+// e.g. from a peer ehco or a generic WS client), dials remoteAddr and
+// encodes that leg with relay.dialCodec, then pipes bytes between the two
+// until either side closes. The two codecs are independent, so a Relay can
+// e.g. accept plain TCP and encode outbound to a WS/TLS peer, or decode an
+// inbound WS/TLS handshake and dial a plain backend.
+func (relay *Relay) HandleTCPConn(c *net.TCPConn, remoteAddr *net.TCPAddr) error {
+	local, err := relay.listenCodec.Decode(relay.ctx, c)
 	if err != nil {
 		return err
 	}
-	return err1
-}
 
-func (relay *Relay) HandleTCPConn(c *net.TCPConn) error {
-	rc, err := net.Dial("tcp", relay.RemoteTCPAddr.String())
+	conn, err := relay.Transport.Dial(relay.ctx, "tcp", remoteAddr.String())
+	if err != nil {
+		return err
+	}
+	rc, err := relay.dialCodec.Encode(relay.ctx, conn)
 	if err != nil {
+		conn.Close()
 		return err
 	}
-	defer rc.Close()
 
-	if relay.TCPDeadline != 0 {
-		if err := rc.SetDeadline(time.Now().Add(time.Duration(relay.TCPDeadline) * time.Second)); err != nil {
-			return err
+	return pipe(local, rc, relay.tcpIdleTimeout())
+}
+
+// watchContext arranges for conn's deadline to be tripped the moment ctx is
+// canceled, so a blocking Read/Write/Handshake on conn unblocks promptly
+// instead of leaking past Shutdown. Callers must always invoke the returned
+// stop once the blocking call returns, to release the watcher goroutine.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
 		}
+	}()
+	return func() { close(done) }
+}
+
+// tcpIdleTimeout converts TCPDeadline into the idle timeout pipe enforces
+// between reads/writes. Zero means no deadline.
+func (relay *Relay) tcpIdleTimeout() time.Duration {
+	if relay.TCPDeadline == 0 {
+		return 0
+	}
+	return time.Duration(relay.TCPDeadline) * time.Second
+}
+
+// HandleUDP forwards an inbound client packet received on port index i to
+// the matching RemoteUDPAddrs[i], dialing and caching a *net.UDPConn per
+// client source address so replies can find their way back. The session is
+// expired after UDPDeadline seconds of inactivity.
+func (relay *Relay) HandleUDP(i int, addr *net.UDPAddr, b []byte) error {
+	ue, err := relay.getOrDialUDPExchange(i, addr)
+	if err != nil {
+		return err
+	}
+	relay.resetUDPDeadline(ue)
+	if _, err := ue.RemoteConn.Write(b); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (relay *Relay) getOrDialUDPExchange(i int, addr *net.UDPAddr) (*UDPExchange, error) {
+	key := fmt.Sprintf("%d|%s", i, addr.String())
+
+	relay.udpExchangesMu.Lock()
+	ue, ok := relay.UDPExchanges[key]
+	relay.udpExchangesMu.Unlock()
+	if ok {
+		return ue, nil
 	}
 
+	rc, err := net.DialUDP("udp", nil, relay.RemoteUDPAddrs[i])
+	if err != nil {
+		return nil, err
+	}
+	ue = &UDPExchange{RemoteConn: rc, ClientAddr: addr, LocalConn: relay.UDPConns[i], key: key}
+
+	// Another goroutine may have raced us from the ok-check above to here
+	// and already inserted a session for key (e.g. a burst of packets
+	// arriving for the same client before any session exists yet). Check
+	// again under the lock and discard our dial if so, so at most one
+	// UDPExchange and one dialed socket ever wins per key.
+	relay.udpExchangesMu.Lock()
+	if existing, ok := relay.UDPExchanges[key]; ok {
+		relay.udpExchangesMu.Unlock()
+		rc.Close()
+		return existing, nil
+	}
+	relay.UDPExchanges[key] = ue
+	relay.udpExchangesMu.Unlock()
+
+	relay.wg.Add(1)
 	go func() {
-		var bf [1024 * 2]byte
-		for {
-			if relay.TCPDeadline != 0 {
-				if err := rc.SetDeadline(time.Now().Add(time.Duration(relay.TCPDeadline) * time.Second)); err != nil {
-					return
-				}
-			}
-			i, err := rc.Read(bf[:])
-			if err != nil {
-				return
-			}
-			if _, err := c.Write(bf[0:i]); err != nil {
-				return
-			}
+		defer relay.wg.Done()
+		if err := relay.RunUDPExchange(ue); err != nil {
+			log.Println(err)
 		}
 	}()
 
-	var bf [1024 * 2]byte
-	for {
-		if relay.TCPDeadline != 0 {
-			if err := c.SetDeadline(time.Now().Add(time.Duration(relay.TCPDeadline) * time.Second)); err != nil {
-				return nil
-			}
+	return ue, nil
+}
+
+// RunUDPExchange reads reply packets off ue.RemoteConn and writes them back
+// to the originating client address until the conn is closed by deadline
+// expiry or a read error.
+func (relay *Relay) RunUDPExchange(ue *UDPExchange) error {
+	defer relay.dropUDPExchange(ue)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-relay.ctx.Done():
+			ue.RemoteConn.SetDeadline(time.Unix(1, 0))
+		case <-done:
 		}
-		i, err := c.Read(bf[:])
+	}()
+
+	bfp := udpBufferPool.Get().(*[]byte)
+	defer udpBufferPool.Put(bfp)
+	bf := *bfp
+
+	for {
+		n, err := ue.RemoteConn.Read(bf)
 		if err != nil {
-			return nil
+			return err
 		}
-		if _, err := rc.Write(bf[0:i]); err != nil {
-			return nil
+		relay.resetUDPDeadline(ue)
+		if _, err := ue.LocalConn.WriteToUDP(bf[0:n], ue.ClientAddr); err != nil {
+			return err
 		}
 	}
-	return nil
 }
 
-func (relay *Relay) HandleUDP(addr *net.UDPAddr, b []byte) error {
-	return nil
+func (relay *Relay) dropUDPExchange(ue *UDPExchange) {
+	relay.udpExchangesMu.Lock()
+	if cur, ok := relay.UDPExchanges[ue.key]; ok && cur == ue {
+		delete(relay.UDPExchanges, ue.key)
+	}
+	relay.udpExchangesMu.Unlock()
+	ue.RemoteConn.Close()
+}
+
+// resetUDPDeadline (re)arms the idle timer for ue so the session is closed
+// and evicted after UDPDeadline seconds without a send or receive. A
+// UDPDeadline of 0 disables expiry. HandleUDP and RunUDPExchange both call
+// this for the same ue from different goroutines, so ue.timer is guarded by
+// ue.timerMu rather than being read/written bare.
+func (relay *Relay) resetUDPDeadline(ue *UDPExchange) {
+	if relay.UDPDeadline == 0 {
+		return
+	}
+	d := time.Duration(relay.UDPDeadline) * time.Second
+
+	ue.timerMu.Lock()
+	defer ue.timerMu.Unlock()
+	if ue.timer == nil {
+		ue.timer = time.AfterFunc(d, func() { relay.dropUDPExchange(ue) })
+		return
+	}
+	ue.timer.Reset(d)
 }
@@ -0,0 +1,66 @@
+package ehco
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// BenchmarkPipe relays a payload between two TCP loopback connections
+// through pipe, exercising the pooled-buffer copy and, on Linux, the
+// splice(2) fast path between the two *net.TCPConn legs.
+func BenchmarkPipe(b *testing.B) {
+	const payloadSize = 4 << 20 // 4 MiB
+
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			uc, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, uc)
+		}
+	}()
+
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer front.Close()
+	go func() {
+		for {
+			c, err := front.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				rc, err := net.Dial("tcp", upstream.Addr().String())
+				if err != nil {
+					c.Close()
+					return
+				}
+				pipe(c, rc, 0)
+			}()
+		}
+	}()
+
+	payload := make([]byte, payloadSize)
+	b.SetBytes(payloadSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", front.Addr().String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := conn.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+		conn.Close()
+	}
+}
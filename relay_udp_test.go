@@ -0,0 +1,155 @@
+package ehco
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestUDPRelay builds a Relay with a single UDP port pair listening on
+// loopback, with udpDeadline seconds of idle expiry.
+func newTestUDPRelay(t *testing.T, udpDeadline int) (*Relay, *net.UDPConn) {
+	t.Helper()
+
+	remote, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { remote.Close() })
+
+	relay, err := NewRelay("127.0.0.1:0", remote.LocalAddr().String(), 0, 0, udpDeadline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay.ctx, relay.cancel = context.WithCancel(context.Background())
+	t.Cleanup(relay.cancel)
+
+	return relay, remote
+}
+
+// TestHandleUDPConcurrentResetUDPDeadline exercises HandleUDP and
+// RunUDPExchange's reply loop racing to reset the same UDPExchange's idle
+// timer, reproducing the data race `go test -race` catches on ue.timer.
+func TestHandleUDPConcurrentResetUDPDeadline(t *testing.T) {
+	relay, remote := newTestUDPRelay(t, 1)
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	relay.UDPConns[0] = local
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := remote.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			remote.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := relay.HandleUDP(0, clientAddr, []byte{byte(i)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	relay.udpExchangesMu.Lock()
+	n := len(relay.UDPExchanges)
+	relay.udpExchangesMu.Unlock()
+	if n != 1 {
+		t.Fatalf("UDPExchanges has %d sessions, want 1", n)
+	}
+}
+
+// TestGetOrDialUDPExchangeDedupesConcurrentDials reproduces a burst of
+// packets arriving for one client before its session exists: firing many
+// concurrent getOrDialUDPExchange calls for the same key must still dial
+// exactly one upstream socket and hand every caller back that same
+// *UDPExchange, not a mix of distinct sessions that each won a race.
+func TestGetOrDialUDPExchangeDedupesConcurrentDials(t *testing.T) {
+	relay, _ := newTestUDPRelay(t, 0)
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	relay.UDPConns[0] = local
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+
+	const n = 200
+	results := make([]*UDPExchange, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ue, err := relay.getOrDialUDPExchange(0, clientAddr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = ue
+		}(i)
+	}
+	wg.Wait()
+
+	first := results[0]
+	for i, ue := range results {
+		if ue != first {
+			t.Fatalf("getOrDialUDPExchange call %d returned a different session than call 0; want every concurrent caller to share one dialed session", i)
+		}
+	}
+}
+
+// TestUDPExchangeExpiresAndIsDropped confirms a session's idle timer evicts
+// it from UDPExchanges once UDPDeadline elapses without traffic.
+func TestUDPExchangeExpiresAndIsDropped(t *testing.T) {
+	relay, _ := newTestUDPRelay(t, 1)
+
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	relay.UDPConns[0] = local
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	key := fmt.Sprintf("%d|%s", 0, clientAddr.String())
+
+	if err := relay.HandleUDP(0, clientAddr, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	relay.udpExchangesMu.Lock()
+	_, ok := relay.UDPExchanges[key]
+	relay.udpExchangesMu.Unlock()
+	if !ok {
+		t.Fatal("expected a UDPExchange to be tracked after HandleUDP")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		relay.udpExchangesMu.Lock()
+		_, stillThere := relay.UDPExchanges[key]
+		relay.udpExchangesMu.Unlock()
+		if !stillThere {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("UDPExchange was not evicted after its idle deadline")
+}
@@ -0,0 +1,148 @@
+package ehco
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncodeAddrTLV(t *testing.T) {
+	cases := []struct {
+		addr string
+		typ  byte
+	}{
+		{"192.0.2.1:443", gostAddrIPv4},
+		{"example.com:443", gostAddrDomain},
+		{"[2001:db8::1]:443", gostAddrIPv6},
+	}
+	for _, c := range cases {
+		tlv, err := encodeAddrTLV(c.addr)
+		if err != nil {
+			t.Fatalf("encodeAddrTLV(%q): %v", c.addr, err)
+		}
+		if tlv[0] != gostFeatureAddr {
+			t.Fatalf("encodeAddrTLV(%q): type byte = %#x, want gostFeatureAddr", c.addr, tlv[0])
+		}
+		if got, want := int(tlv[1]), len(tlv)-2; got != want {
+			t.Fatalf("encodeAddrTLV(%q): length byte = %d, want %d", c.addr, got, want)
+		}
+		if tlv[2] != c.typ {
+			t.Fatalf("encodeAddrTLV(%q): ATYP = %#x, want %#x", c.addr, tlv[2], c.typ)
+		}
+	}
+}
+
+func TestEncodeAddrTLVInvalidPort(t *testing.T) {
+	if _, err := encodeAddrTLV("example.com:not-a-port"); err == nil {
+		t.Fatal("expected an error for a non-numeric port")
+	}
+}
+
+func TestEncodeUserAuthTLV(t *testing.T) {
+	tlv := encodeUserAuthTLV("alice", "hunter2")
+	if tlv[0] != gostFeatureUserAuth {
+		t.Fatalf("type byte = %#x, want gostFeatureUserAuth", tlv[0])
+	}
+	userLen := int(tlv[2])
+	if got, want := string(tlv[3:3+userLen]), "alice"; got != want {
+		t.Fatalf("username = %q, want %q", got, want)
+	}
+	passLen := int(tlv[3+userLen])
+	if got, want := string(tlv[4+userLen:4+userLen+passLen]), "hunter2"; got != want {
+		t.Fatalf("password = %q, want %q", got, want)
+	}
+}
+
+// fakeGostServer accepts a single connection, reads the version/feature-count
+// handshake header, and writes back the given reply bytes.
+func fakeGostServer(t *testing.T, reply []byte) net.Addr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		hdr := make([]byte, 2)
+		if _, err := c.Read(hdr); err != nil {
+			return
+		}
+		for i := byte(0); i < hdr[1]; i++ {
+			th := make([]byte, 2)
+			if _, err := c.Read(th); err != nil {
+				return
+			}
+			c.Read(make([]byte, th[1]))
+		}
+		c.Write(reply)
+	}()
+	return ln.Addr()
+}
+
+func TestGostRelayTransportDialSuccess(t *testing.T) {
+	addr := fakeGostServer(t, []byte{gostVersion1, 0})
+	transport := &GostRelayTransport{Addr: addr.String()}
+
+	conn, err := transport.Dial(context.Background(), "tcp", "198.51.100.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestGostRelayTransportDialRefused(t *testing.T) {
+	addr := fakeGostServer(t, []byte{gostVersion1, 1})
+	transport := &GostRelayTransport{Addr: addr.String()}
+
+	if _, err := transport.Dial(context.Background(), "tcp", "198.51.100.1:80"); err == nil {
+		t.Fatal("expected an error when the relay refuses the connection")
+	}
+}
+
+// TestGostRelayTransportDialCanceled confirms a canceled ctx unblocks a
+// handshake stuck waiting on an unresponsive relay, instead of hanging.
+func TestGostRelayTransportDialCanceled(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		select {} // never replies
+	}()
+
+	transport := &GostRelayTransport{Addr: ln.Addr().String()}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := transport.Dial(ctx, "tcp", "198.51.100.1:80")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error once ctx was canceled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dial did not return after ctx was canceled")
+	}
+}
@@ -0,0 +1,264 @@
+package ehco
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// wsGUID is the fixed key defined by RFC 6455 for computing
+// Sec-WebSocket-Accept.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocketCodec is an EncodeDecoder that completes an HTTP/1.1 Upgrade
+// handshake and then carries the relayed bytes as binary WebSocket frames,
+// so the stream can pass through firewalls/CDNs that only allow HTTP(S).
+type WebSocketCodec struct {
+	// Path is the HTTP path used for the upgrade request/response.
+	// Defaults to "/".
+	Path string
+	// Host is the Host header sent by Encode. Defaults to the remote
+	// conn's address if empty.
+	Host string
+}
+
+func (w *WebSocketCodec) path() string {
+	if w.Path == "" {
+		return "/"
+	}
+	return w.Path
+}
+
+// Encode performs the client side of the WebSocket upgrade handshake. It
+// aborts if ctx is canceled before the far side responds.
+func (w *WebSocketCodec) Encode(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	stop := watchContext(ctx, conn)
+	defer stop()
+
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	secKey := base64.StdEncoding.EncodeToString(key)
+
+	host := w.Host
+	if host == "" {
+		host = conn.RemoteAddr().String()
+	}
+
+	req := fmt.Sprintf(
+		"GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		w.path(), host, secKey,
+	)
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("ehco: websocket upgrade rejected: %s", resp.Status)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), wsAcceptKey(secKey); got != want {
+		return nil, fmt.Errorf("ehco: websocket Sec-WebSocket-Accept mismatch")
+	}
+
+	return &wsConn{Conn: conn, br: br, masked: true}, nil
+}
+
+// Decode performs the server side of the WebSocket upgrade handshake. It
+// aborts if ctx is canceled before the connecting side completes it.
+func (w *WebSocketCodec) Decode(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	stop := watchContext(ctx, conn)
+	defer stop()
+
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return nil, fmt.Errorf("ehco: expected a websocket upgrade request")
+	}
+	if req.URL.Path != w.path() {
+		return nil, fmt.Errorf("ehco: unexpected websocket path %q", req.URL.Path)
+	}
+
+	resp := fmt.Sprintf(
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		wsAcceptKey(req.Header.Get("Sec-WebSocket-Key")),
+	)
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		return nil, err
+	}
+
+	return &wsConn{Conn: conn, br: br, masked: false}, nil
+}
+
+func wsAcceptKey(secKey string) string {
+	h := sha1.New()
+	h.Write([]byte(secKey + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsConn adapts a binary WebSocket frame stream to net.Conn. masked reports
+// whether this side must mask the frames it writes, per RFC 6455 (clients
+// mask, servers don't).
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	masked bool
+
+	buffered []byte
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for len(c.buffered) == 0 {
+		payload, err := readWSFrame(c.br)
+		if err != nil {
+			return 0, err
+		}
+		c.buffered = payload
+	}
+	n := copy(p, c.buffered)
+	c.buffered = c.buffered[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := writeWSFrame(c.Conn, p, c.masked); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+const (
+	wsOpcodeBinary = 0x2
+	wsOpcodeClose  = 0x8
+	wsOpcodePing   = 0x9
+	wsOpcodePong   = 0xA
+)
+
+func writeWSFrame(w io.Writer, payload []byte, masked bool) error {
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+
+	hdr := []byte{0x80 | wsOpcodeBinary}
+	switch {
+	case len(payload) < 126:
+		hdr = append(hdr, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(len(payload)))
+		hdr = append(hdr, maskBit|126)
+		hdr = append(hdr, ext...)
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(len(payload)))
+		hdr = append(hdr, maskBit|127)
+		hdr = append(hdr, ext...)
+	}
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+
+	if !masked {
+		_, err := w.Write(payload)
+		return err
+	}
+
+	maskKey := make([]byte, 4)
+	if _, err := rand.Read(maskKey); err != nil {
+		return err
+	}
+	if _, err := w.Write(maskKey); err != nil {
+		return err
+	}
+	out := make([]byte, len(payload))
+	for i, b := range payload {
+		out[i] = b ^ maskKey[i%4]
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// maxWSFramePayload bounds the payload length readWSFrame will allocate for,
+// so a peer claiming an absurd extended length (up to 2^64-1) can't force an
+// oversized allocation or an out-of-range makeslice. This is generous enough
+// for any relayed chunk pipe actually writes (32 KiB, see pipeBufferPool).
+const maxWSFramePayload = 16 << 20 // 16 MiB
+
+// readWSFrame reads one WebSocket frame and returns its payload, looping
+// past ping/pong control frames (rather than recursing, which would grow the
+// call stack unboundedly for a peer that sends nothing else) and treating a
+// close frame as io.EOF.
+func readWSFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return nil, err
+		}
+		opcode := head[0] & 0x0F
+		masked := head[1]&0x80 != 0
+		length := uint64(head[1] & 0x7F)
+
+		switch length {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(ext)
+		}
+		if length > maxWSFramePayload {
+			return nil, fmt.Errorf("ehco: websocket frame payload of %d bytes exceeds the %d byte limit", length, uint64(maxWSFramePayload))
+		}
+
+		var maskKey []byte
+		if masked {
+			maskKey = make([]byte, 4)
+			if _, err := io.ReadFull(r, maskKey); err != nil {
+				return nil, err
+			}
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= maskKey[i%4]
+			}
+		}
+
+		switch opcode {
+		case wsOpcodeClose:
+			return nil, io.EOF
+		case wsOpcodePing, wsOpcodePong:
+			continue
+		default:
+			return payload, nil
+		}
+	}
+}
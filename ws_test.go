@@ -0,0 +1,85 @@
+package ehco
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// wsFrame builds a raw (unmasked) WebSocket frame for opcode/payload, using
+// the extended-length form matching length's size the same way writeWSFrame
+// does, so tests can feed arbitrary frames straight into readWSFrame.
+func wsFrame(opcode byte, length uint64, payload []byte) []byte {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(length))
+		frame = append(frame, 126)
+		frame = append(frame, ext...)
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, length)
+		frame = append(frame, 127)
+		frame = append(frame, ext...)
+	}
+	return append(frame, payload...)
+}
+
+func TestReadWSFrameRejectsOversizedLength(t *testing.T) {
+	// Claim an absurd payload length with no actual bytes behind it; a
+	// naive make([]byte, length) would try to allocate ~1 PiB.
+	frame := wsFrame(wsOpcodeBinary, 1<<50, nil)
+	r := bufio.NewReader(bytes.NewReader(frame))
+
+	_, err := readWSFrame(r)
+	if err == nil {
+		t.Fatal("expected an error for a frame claiming an oversized payload length")
+	}
+}
+
+func TestReadWSFrameAllowsMaxPayload(t *testing.T) {
+	payload := make([]byte, maxWSFramePayload)
+	frame := wsFrame(wsOpcodeBinary, uint64(len(payload)), payload)
+	r := bufio.NewReader(bytes.NewReader(frame))
+
+	got, err := readWSFrame(r)
+	if err != nil {
+		t.Fatalf("readWSFrame at the max allowed payload size: %v", err)
+	}
+	if len(got) != len(payload) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(payload))
+	}
+}
+
+// TestReadWSFrameLoopsPastPings confirms a long run of ping frames before
+// the actual data frame is handled by looping rather than recursing, so it
+// can't grow the goroutine's call stack without bound.
+func TestReadWSFrameLoopsPastPings(t *testing.T) {
+	var buf bytes.Buffer
+	const pings = 200000
+	for i := 0; i < pings; i++ {
+		buf.Write(wsFrame(wsOpcodePing, 0, nil))
+	}
+	buf.Write(wsFrame(wsOpcodeBinary, 2, []byte("hi")))
+
+	r := bufio.NewReader(&buf)
+	got, err := readWSFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hi" {
+		t.Fatalf("got %q, want %q", got, "hi")
+	}
+}
+
+func TestReadWSFrameCloseIsEOF(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(wsFrame(wsOpcodeClose, 0, nil)))
+	if _, err := readWSFrame(r); err != io.EOF {
+		t.Fatalf("readWSFrame on a close frame: err = %v, want io.EOF", err)
+	}
+}